@@ -38,6 +38,14 @@ type tempRaftContext struct {
 	applyState mraft.RaftApplyState
 	lastTerm   uint64
 	snapCell   *metapb.Cell
+
+	wb      metaWriteBatch
+	wbBytes uint64
+
+	// cachedEntries are the entries doAppendEntries staged for this Ready
+	// cycle, not yet added to raftLogCaches; doSaveReadyState adds them once
+	// ctx.commit() confirms they're durable.
+	cachedEntries []raftpb.Entry
 }
 
 type applySnapResult struct {
@@ -83,19 +91,38 @@ func (q *readIndexQueue) getReadyCnt() int32 {
 }
 
 // ====================== raft ready handle methods
-func (ps *peerStorage) doAppendSnapshot(ctx *tempRaftContext, snap raftpb.Snapshot) error {
+func (ps *peerStorage) doAppendSnapshot(ctx *tempRaftContext, snap raftpb.Snapshot, leaderID uint64) error {
 	log.Infof("raftstore[cell-%d]: begin to apply snapshot", ps.getCell().ID)
 
-	snapData := &mraft.RaftSnapshotData{}
-	util.MustUnmarshal(snapData, snap.Data)
+	// snap.Data only ever carries the manifest: the cell's actual data is
+	// staged on disk, chunk by chunk, by the sidecar transport below, and is
+	// what startApplyingSnapJob ingests once this Ready cycle commits.
+	manifest, err := unmarshalManifest(snap.Data)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	if !validateManifestCRC(manifest) {
+		return fmt.Errorf("raftstore[cell-%d]: snapshot manifest checksum mismatch, cell=<%d>",
+			ps.getCell().ID,
+			manifest.Cell.ID)
+	}
 
-	if snapData.Cell.ID != ps.getCell().ID {
+	if manifest.Cell.ID != ps.getCell().ID {
 		return fmt.Errorf("raftstore[cell-%d]: cell not match, snapCell=<%d> currCell=<%d>",
 			ps.getCell().ID,
-			snapData.Cell.ID,
+			manifest.Cell.ID,
 			ps.getCell().ID)
 	}
 
+	leader := ps.store.peerCache.get(leaderID)
+	if err := ps.fetchAndStageSnapChunks(manifest, leader); err != nil {
+		log.Errorf("raftstore[cell-%d]: fetch snapshot chunks failed, errors:\n %+v",
+			ps.getCell().ID,
+			err)
+		return err
+	}
+
 	if ps.isInitialized() {
 		err := ps.clearMeta()
 		if err != nil {
@@ -106,7 +133,7 @@ func (ps *peerStorage) doAppendSnapshot(ctx *tempRaftContext, snap raftpb.Snapsh
 		}
 	}
 
-	err := ps.updatePeerState(ps.getCell(), mraft.Applying)
+	err = ps.updatePeerState(ctx, ps.getCell(), mraft.Applying)
 	if err != nil {
 		log.Errorf("raftstore[cell-%d]: write peer state failed, errors:\n %+v",
 			ps.getCell().ID,
@@ -126,11 +153,13 @@ func (ps *peerStorage) doAppendSnapshot(ctx *tempRaftContext, snap raftpb.Snapsh
 	ctx.applyState.TruncatedState.Index = lastIndex
 	ctx.applyState.TruncatedState.Term = lastTerm
 
+	ps.store.raftLogCaches.get(ps.getCell().ID).compactTo(lastIndex)
+
 	log.Infof("raftstore[cell-%d]: apply snapshot ok, state=<%s>",
 		ps.getCell().ID,
 		ctx.applyState.String())
 
-	c := snapData.Cell
+	c := manifest.Cell
 	ctx.snapCell = &c
 
 	return nil
@@ -154,9 +183,14 @@ func (ps *peerStorage) doAppendEntries(ctx *tempRaftContext, entries []raftpb.En
 	lastIndex := entries[c-1].Index
 	lastTerm := entries[c-1].Term
 
+	engine := ps.store.getMetaEngine().(metaWriteBatchEngine)
+	wb := ctx.writeBatch(engine)
+
 	for _, e := range entries {
 		d := util.MustMarshal(&e)
-		err := ps.store.getMetaEngine().Set(getRaftLogKey(ps.getCell().ID, e.Index), d)
+		key := getRaftLogKey(ps.getCell().ID, e.Index)
+
+		err := wb.Put(key, d)
 		if err != nil {
 			log.Errorf("raftstore[cell-%d]: append entry failure, entry=<%s> errors:\n %+v",
 				ps.getCell().ID,
@@ -164,11 +198,22 @@ func (ps *peerStorage) doAppendEntries(ctx *tempRaftContext, entries []raftpb.En
 				err)
 			return err
 		}
+
+		ctx.wbBytes += uint64(len(key) + len(d))
 	}
 
+	// The whole Ready cycle - these entries, the truncate-tail deletes below,
+	// and the RaftLocalState/RaftApplyState saved afterwards - must land in
+	// the same Commit so a crash can never observe one without the others.
+	// A batch-size cap that split this into multiple commits would trade that
+	// guarantee away for a case etcd/raft already bounds on its own (Ready
+	// batches entries up to MaxSizePerMsg/MaxCommittedSizePerReady), so there
+	// is no RaftMaxBatchBytes knob here: the single end-of-Ready commit always
+	// carries the whole thing.
+
 	// Delete any previously appended log entries which never committed.
 	for index := lastIndex + 1; index < prevLastIndex+1; index++ {
-		err := ps.store.getMetaEngine().Delete(getRaftLogKey(ps.getCell().ID, index))
+		err := wb.Delete(getRaftLogKey(ps.getCell().ID, index))
 		if err != nil {
 			log.Errorf("raftstore[cell-%d]: delete any previously appended log entries failure, index=<%d> errors:\n %+v",
 				ps.getCell().ID,
@@ -181,12 +226,41 @@ func (ps *peerStorage) doAppendEntries(ctx *tempRaftContext, entries []raftpb.En
 	ctx.raftState.LastIndex = lastIndex
 	ctx.lastTerm = lastTerm
 
+	// Only cache these entries once ctx.commit() has actually persisted them -
+	// caching them here, before the batch commits, would let a reader observe
+	// an entry from the cache that a crash right after this call could make
+	// vanish from the engine, leaving the two permanently out of sync.
+	ctx.cachedEntries = entries
+
+	return nil
+}
+
+// updatePeerState persists the cell's peer state (e.g. Applying while a
+// snapshot is still being staged and ingested) into ctx's write batch, so it
+// lands in the same Commit as everything else doSaveReadyState writes for
+// this Ready cycle instead of through an engine write of its own.
+func (ps *peerStorage) updatePeerState(ctx *tempRaftContext, cell metapb.Cell, state mraft.PeerState) error {
+	peerState := mraft.CellLocalState{
+		Cell:  cell,
+		State: state,
+	}
+
+	key := getCellStateKey(cell.ID)
+	data := util.MustMarshal(&peerState)
+
+	wb := ctx.writeBatch(ps.store.getMetaEngine().(metaWriteBatchEngine))
+	if err := wb.Put(key, data); err != nil {
+		return err
+	}
+
+	ctx.wbBytes += uint64(len(key) + len(data))
 	return nil
 }
 
 func (pr *PeerReplicate) doSaveRaftState(ctx *tempRaftContext) error {
 	data, _ := ctx.raftState.Marshal()
-	err := pr.store.getMetaEngine().Set(getRaftStateKey(pr.ps.getCell().ID), data)
+	wb := ctx.writeBatch(pr.store.getMetaEngine().(metaWriteBatchEngine))
+	err := wb.Put(getRaftStateKey(pr.ps.getCell().ID), data)
 	if err != nil {
 		log.Errorf("raftstore[cell-%d]: save temp raft state failure, errors:\n %+v",
 			pr.ps.getCell().ID,
@@ -197,7 +271,8 @@ func (pr *PeerReplicate) doSaveRaftState(ctx *tempRaftContext) error {
 }
 
 func (pr *PeerReplicate) doSaveApplyState(ctx *tempRaftContext) error {
-	err := pr.store.getMetaEngine().Set(getApplyStateKey(pr.ps.getCell().ID), util.MustMarshal(&ctx.applyState))
+	wb := ctx.writeBatch(pr.store.getMetaEngine().(metaWriteBatchEngine))
+	err := wb.Put(getApplyStateKey(pr.ps.getCell().ID), util.MustMarshal(&ctx.applyState))
 	if err != nil {
 		log.Errorf("raftstore[cell-%d]: save temp apply state failure, errors:\n %+v",
 			pr.ps.getCell().ID,
@@ -207,6 +282,60 @@ func (pr *PeerReplicate) doSaveApplyState(ctx *tempRaftContext) error {
 	return err
 }
 
+// doSaveReadyState persists everything a raft.Ready cycle needs durable
+// before it is acted on: an incoming snapshot's metadata, newly appended
+// entries, RaftLocalState and RaftApplyState. All of it goes into ctx's
+// single write batch and is committed exactly once here, at the
+// Ready-to-storage boundary, so a crash can never observe the raft log
+// without the state that describes it.
+func (pr *PeerReplicate) doSaveReadyState(rd *raft.Ready) (*tempRaftContext, error) {
+	ctx := &tempRaftContext{
+		raftState:  pr.ps.raftState,
+		applyState: pr.ps.getApplyState(),
+		lastTerm:   pr.ps.lastTerm,
+	}
+
+	if !raft.IsEmptySnap(rd.Snapshot) {
+		if err := pr.ps.doAppendSnapshot(ctx, rd.Snapshot, pr.rn.Status().Lead); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rd.Entries) > 0 {
+		if err := pr.ps.doAppendEntries(ctx, rd.Entries); err != nil {
+			return nil, err
+		}
+	}
+
+	if !raft.IsEmptyHardState(rd.HardState) {
+		ctx.raftState.HardState = rd.HardState
+	}
+
+	if err := pr.doSaveRaftState(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := pr.doSaveApplyState(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.commit(); err != nil {
+		log.Errorf("raftstore[cell-%d]: commit raft ready state failed, errors:\n %+v",
+			pr.ps.getCell().ID,
+			err)
+		return nil, err
+	}
+
+	if len(ctx.cachedEntries) > 0 {
+		pr.store.raftLogCaches.get(pr.ps.getCell().ID).append(ctx.cachedEntries)
+		pr.store.raftLogCaches.reclaim()
+	}
+
+	pr.maybeRenewLease(time.Now())
+
+	return ctx, nil
+}
+
 func (pr *PeerReplicate) doApplySnap(ctx *tempRaftContext) *applySnapResult {
 	pr.ps.raftState = ctx.raftState
 	pr.ps.setApplyState(&ctx.applyState)
@@ -233,6 +362,7 @@ func (pr *PeerReplicate) doApplySnap(ctx *tempRaftContext) *applySnapResult {
 		}
 	}
 
+	pr.ps.beginApplyingSnap()
 	pr.startApplyingSnapJob()
 
 	prevCell := pr.ps.getCell()
@@ -262,6 +392,25 @@ func (pr *PeerReplicate) applyCommittedEntries(rd *raft.Ready) bool {
 }
 
 func (pr *PeerReplicate) doPropose(meta *proposalMeta, isConfChange bool, cmd *cmd) error {
+	if !isConfChange && cmd.isReadOnlyRequest() {
+		if pr.tryLeaseRead(cmd) {
+			return nil
+		}
+
+		// The fast path missed, so this read needs raft's own ReadIndex
+		// confirmation: ReadIndex asks rn to record the current commit index
+		// against cmd's UUID and, once a quorum acks it, hand it back through
+		// rd.ReadStates on a later Ready - which is what doApplyReads drains to
+		// satisfy the pendingReads entry queued for it below. Without this call
+		// nothing ever triggers that round trip and the read would sit in
+		// pendingReads forever.
+		if err := pr.rn.ReadIndex(context.TODO(), cmd.getUUID()); err != nil {
+			return err
+		}
+
+		return pr.pendingReads.push(cmd)
+	}
+
 	delegate := pr.store.delegates.get(pr.cellID)
 	if delegate == nil {
 		cmd.respCellNotFound(pr.cellID, meta.term)
@@ -384,12 +533,21 @@ func (pr *PeerReplicate) doPostApply(result *asyncApplyResult) {
 	}
 }
 
-func (s *Store) doPostApplyResult(result *asyncApplyResult) {
-	switch result.result.adminType {
-	case raftcmdpb.ChangePeer:
-		s.doApplyConfChange(result.cellID, result.result.changePeer)
-	case raftcmdpb.Split:
-		s.doApplySplit(result.cellID, result.result.splitResult)
+// doPostApplyResult dispatches a result delivered through store.notify to
+// its handler. asyncApplyResult comes from the committed-entries apply
+// worker, snapApplyResult from the apply-snapshot worker started by
+// startApplyingSnapJob.
+func (s *Store) doPostApplyResult(result interface{}) {
+	switch r := result.(type) {
+	case *asyncApplyResult:
+		switch r.result.adminType {
+		case raftcmdpb.ChangePeer:
+			s.doApplyConfChange(r.cellID, r.result.changePeer)
+		case raftcmdpb.Split:
+			s.doApplySplit(r.cellID, r.result.splitResult)
+		}
+	case *snapApplyResult:
+		s.doPostApplySnapResult(r)
 	}
 }
 
@@ -407,6 +565,7 @@ func (s *Store) doApplyConfChange(cellID uint64, cp *changePeer) {
 	}
 
 	pr.ps.setCell(cp.cell)
+	pr.invalidateLease()
 
 	if pr.isLeader() {
 		// Notify pd immediately.
@@ -421,6 +580,12 @@ func (s *Store) doApplyConfChange(cellID uint64, cp *changePeer) {
 		// Add this peer to cache.
 		pr.peerHeartbeatsMap.put(cp.peer.ID, time.Now())
 		s.peerCache.put(cp.peer.ID, cp.peer)
+	case raftpb.ConfChangeAddLearnerNode:
+		// A learner never counts toward the voting quorum, so adding one
+		// never reduces availability. The leader proposes its promotion
+		// (maybePromoteLearners) once its match index is caught up.
+		pr.peerHeartbeatsMap.put(cp.peer.ID, time.Now())
+		s.peerCache.put(cp.peer.ID, cp.peer)
 	case raftpb.ConfChangeRemoveNode:
 		// Remove this peer from cache.
 		pr.peerHeartbeatsMap.delete(cp.peer.ID)
@@ -429,6 +594,10 @@ func (s *Store) doApplyConfChange(cellID uint64, cp *changePeer) {
 		// We only care remove itself now.
 		if cp.peer.StoreID == pr.store.GetID() {
 			if cp.peer.ID == pr.peer.ID {
+				// Cancel any in-flight apply-snapshot job instead of
+				// letting destroyPeer block on it reaching rocksdb.
+				pr.ps.abortApplyingSnap()
+				s.raftLogCaches.delete(cellID)
 				s.destroyPeer(cellID, cp.peer, false)
 			} else {
 				log.Fatalf("raftstore-apply[cell-%d]: trying to remove unknown peer, peer=<%+v>",
@@ -545,6 +714,8 @@ func (pr *PeerReplicate) doApplyReads(rd *raft.Ready) {
 	// actually stale.
 	if rd.SoftState != nil {
 		if rd.SoftState.RaftState != raft.StateLeader {
+			pr.invalidateLease()
+
 			n := int(pr.pendingReads.getReadyCnt())
 			if n > 0 {
 				// all uncommitted reads will be dropped silently in raft.
@@ -606,9 +777,7 @@ func (ps *peerStorage) InitialState() (raftpb.HardState, raftpb.ConfState, error
 		return hardState, confState, nil
 	}
 
-	for _, p := range ps.getCell().Peers {
-		confState.Nodes = append(confState.Nodes, p.ID)
-	}
+	confState = confStateFromCell(ps.getCell())
 
 	return hardState, confState, nil
 }
@@ -624,13 +793,22 @@ func (ps *peerStorage) Entries(low, high, maxSize uint64) ([]raftpb.Entry, error
 		return ents, nil
 	}
 
+	// The cache only ever holds the most recent, contiguous suffix of the
+	// log, so any gap is a missing prefix - [low, engineHigh) - that still
+	// has to come from the engine; [engineHigh, high) is already covered
+	// by cached.
+	cached, engineHigh := ps.store.raftLogCaches.get(ps.getCell().ID).get(low, high)
+	if engineHigh == low {
+		return limitEntriesSize(cached, maxSize), nil
+	}
+
 	var totalSize uint64
 	nextIndex := low
 	exceededMaxSize := false
 
 	startKey := getRaftLogKey(ps.getCell().ID, low)
 
-	if low+1 == high {
+	if low+1 == engineHigh {
 		// If election happens in inactive cells, they will just try
 		// to fetch one empty log.
 		v, err := ps.store.getMetaEngine().Get(startKey)
@@ -648,10 +826,10 @@ func (ps *peerStorage) Entries(low, high, maxSize uint64) ([]raftpb.Entry, error
 		}
 
 		ents = append(ents, *e)
-		return ents, nil
+		return limitEntriesSize(append(ents, cached...), maxSize), nil
 	}
 
-	endKey := getRaftLogKey(ps.getCell().ID, high)
+	endKey := getRaftLogKey(ps.getCell().ID, engineHigh)
 	err = ps.store.getMetaEngine().Scan(startKey, endKey, func(data, value []byte) (bool, error) {
 		e, err := ps.unmarshal(data, nextIndex)
 		if err != nil {
@@ -673,11 +851,18 @@ func (ps *peerStorage) Entries(low, high, maxSize uint64) ([]raftpb.Entry, error
 		return nil, err
 	}
 
-	// If we get the correct number of entries the total size exceeds max_size, returns.
-	if len(ents) == int(high-low) || exceededMaxSize {
+	// If we stopped early on max_size, the cached suffix would only grow
+	// the result past the caller's budget, so return just the engine part.
+	if exceededMaxSize {
 		return ents, nil
 	}
 
+	// If we get the correct number of entries from the engine, the cached
+	// suffix completes the range up to high.
+	if len(ents) == int(engineHigh-low) {
+		return limitEntriesSize(append(ents, cached...), maxSize), nil
+	}
+
 	return nil, raft.ErrUnavailable
 }
 
@@ -700,6 +885,10 @@ func (ps *peerStorage) Term(idx uint64) (uint64, error) {
 		return ps.lastTerm, nil
 	}
 
+	if term, ok := ps.store.raftLogCaches.get(ps.getCell().ID).term(idx); ok {
+		return term, nil
+	}
+
 	key := getRaftLogKey(ps.getCell().ID, idx)
 	v, err := ps.store.getMetaEngine().Get(key)
 	if err != nil {
@@ -727,7 +916,7 @@ func (ps *peerStorage) FirstIndex() (uint64, error) {
 }
 
 func (ps *peerStorage) Snapshot() (raftpb.Snapshot, error) {
-	if ps.isGeneratingSnap() {
+	if ps.isGeneratingSnap() || ps.isApplyingSnap() {
 		return raftpb.Snapshot{}, raft.ErrSnapshotTemporarilyUnavailable
 	}
 
@@ -0,0 +1,185 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/deepfabric/elasticell/pkg/log"
+	"github.com/deepfabric/elasticell/pkg/pb/metapb"
+	"github.com/deepfabric/elasticell/pkg/pb/pdpb"
+	"github.com/deepfabric/elasticell/pkg/util"
+	"golang.org/x/net/context"
+)
+
+// defaultLearnerPromoteThreshold is the default maximum number of log
+// entries a learner's match index is allowed to trail the leader's commit
+// index by before the leader proposes promoting the learner to a voter.
+const defaultLearnerPromoteThreshold = 100
+
+// learnerCaughtUp reports whether a learner has replicated closely enough
+// to the leader's commit index to be promoted to a voting peer without
+// opening an availability gap. maybePromoteLearners, run from
+// handleHeartbeat on the leader, consults this before proposing the
+// promotion itself; the heartbeat sent to pd carries no learner progress.
+func learnerCaughtUp(leaderCommit, learnerMatch, threshold uint64) bool {
+	if threshold == 0 {
+		threshold = defaultLearnerPromoteThreshold
+	}
+
+	if learnerMatch >= leaderCommit {
+		return true
+	}
+
+	return leaderCommit-learnerMatch <= threshold
+}
+
+// handleHeartbeat reports this cell to pd - including which peers pd should
+// consider down or still pending so it can plan replacements and replica
+// counts correctly - and, if this peer is the leader, checks whether any
+// learner has caught up closely enough to be promoted to a voter.
+func (pr *PeerReplicate) handleHeartbeat() {
+	if !pr.isLeader() {
+		return
+	}
+
+	cell := pr.ps.getCell()
+	req := &pdpb.CellHeartbeatReq{
+		Cell:         cell,
+		Leader:       pr.peer,
+		DownPeers:    pr.downPeers(),
+		PendingPeers: pr.pendingPeers(),
+	}
+
+	_, err := pr.store.pdClient.CellHeartbeat(context.TODO(), req)
+	if err != nil {
+		log.Errorf("raftstore[cell-%d]: report heartbeat to pd failed, errors:\n %+v",
+			pr.cellID,
+			err)
+	}
+
+	pr.maybePromoteLearners()
+}
+
+// downPeers reports the cell's peers this leader hasn't heard from within
+// cfg.MaxPeerDownDuration, keyed off peerHeartbeatsMap, which every conf
+// change already keeps current. pd uses this to plan a replacement instead
+// of waiting indefinitely on a replica that is never coming back.
+func (pr *PeerReplicate) downPeers() []*pdpb.PeerStats {
+	var stats []*pdpb.PeerStats
+
+	maxDown := pr.store.cfg.MaxPeerDownDuration
+	now := time.Now()
+
+	for _, p := range pr.ps.getCell().Peers {
+		if p.ID == pr.peer.ID {
+			continue
+		}
+
+		last, ok := pr.peerHeartbeatsMap.get(p.ID)
+		if !ok {
+			continue
+		}
+
+		if down := now.Sub(last); down > maxDown {
+			stats = append(stats, &pdpb.PeerStats{
+				Peer:        p,
+				DownSeconds: uint64(down.Seconds()),
+			})
+		}
+	}
+
+	return stats
+}
+
+// pendingPeers reports peers still catching up on the raft log - trailing
+// behind the last truncated index, typically because they're receiving a
+// snapshot - so pd doesn't count them toward the cell's replication factor
+// until they're actually able to serve reads.
+func (pr *PeerReplicate) pendingPeers() []metapb.Peer {
+	var pending []metapb.Peer
+
+	status := pr.rn.Status()
+	truncatedIndex := pr.ps.getApplyState().TruncatedState.Index
+
+	for _, p := range pr.ps.getCell().Peers {
+		if p.ID == pr.peer.ID {
+			continue
+		}
+
+		progress, ok := status.Progress[p.ID]
+		if !ok || progress.Match < truncatedIndex {
+			pending = append(pending, p)
+		}
+	}
+
+	return pending
+}
+
+// maybePromoteLearners proposes promoting any learner whose match index has
+// caught up to within the configured threshold of the leader's commit
+// index. Promotion is a second, ordinary conf change - ConfChangeAddNode
+// for a peer ID that is already present as a learner - so it goes through
+// the exact same apply path as adding a voter from scratch.
+func (pr *PeerReplicate) maybePromoteLearners() {
+	// raft only ever allows one conf change in flight at a time; proposing a
+	// second before this peer's own pending one is applied just gets it
+	// rejected, and harmlessly re-proposing it every heartbeat while the
+	// learner sits caught up spams that rejection forever. delegate's
+	// pending change-peer cmd is already this cell's single source of truth
+	// for "a conf change is outstanding", so reuse it instead of tracking a
+	// second copy of the same state.
+	delegate := pr.store.delegates.get(pr.cellID)
+	if delegate != nil && delegate.getPendingChangePeerCMD() != nil {
+		return
+	}
+
+	status := pr.rn.Status()
+	cell := pr.ps.getCell()
+	threshold := pr.store.cfg.LearnerPromoteThreshold
+
+	for _, p := range cell.Peers {
+		if p.Role != metapb.Learner {
+			continue
+		}
+
+		progress, ok := status.Progress[p.ID]
+		if !ok || !learnerCaughtUp(status.HardState.Commit, progress.Match, threshold) {
+			continue
+		}
+
+		if err := pr.proposePromoteLearner(p); err != nil {
+			log.Errorf("raftstore[cell-%d]: propose promote learner failed, peer=<%+v> errors:\n %+v",
+				pr.cellID,
+				p,
+				err)
+		}
+	}
+}
+
+// proposePromoteLearner proposes a conf change that re-adds the learner's
+// peer ID with a voter role, the second step of the two-step learner
+// promotion: step one is ConfChangeAddLearnerNode in doApplyConfChange,
+// step two is this ConfChangeAddNode once the learner is caught up.
+func (pr *PeerReplicate) proposePromoteLearner(learner metapb.Peer) error {
+	voter := learner
+	voter.Role = metapb.Voter
+
+	return pr.rn.ProposeConfChange(context.TODO(), raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  learner.ID,
+		Context: util.MustMarshal(&voter),
+	})
+}
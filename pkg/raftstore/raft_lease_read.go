@@ -0,0 +1,175 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// readMode selects how PeerReplicate serves a read-only command.
+type readMode int
+
+const (
+	// ReadIndex always confirms a read against a quorum via raft's
+	// ReadIndex mechanism before executing it.
+	ReadIndex readMode = iota
+	// LeaseRead lets a leader that still holds its lease answer reads
+	// locally, falling back to ReadIndex once the lease has expired.
+	LeaseRead
+	// Unsafe always executes locally with no safety check; only suitable
+	// when staleness is acceptable.
+	Unsafe
+)
+
+const defaultMaxClockDrift = 10 * time.Millisecond
+
+var (
+	leaseReadHitCount      uint64
+	leaseReadFallbackCount uint64
+)
+
+// peerLease bundles the lease's expiry with the term it was renewed in.
+// maybeRenewLease (the Ready-processing goroutine) writes it and
+// invalidateLease (the apply goroutine) clears it, while tryLeaseRead (the
+// propose goroutine) reads it; storing both fields as one atomic.Value
+// means a reader always sees a matching expiry/term pair instead of one
+// written before the other mid-update, the same hazard the hit/fallback
+// counters avoid by being plain atomics instead of a racy struct.
+type peerLease struct {
+	expiry time.Time
+	term   uint64
+}
+
+var zeroLease = &peerLease{}
+
+func (pr *PeerReplicate) loadLease() *peerLease {
+	l, _ := pr.lease.Load().(*peerLease)
+	if l == nil {
+		return zeroLease
+	}
+	return l
+}
+
+// renewLease extends the leader lease after a heartbeat successfully
+// reaches a quorum of the cell's peers.
+func (pr *PeerReplicate) renewLease(now time.Time) {
+	pr.lease.Store(&peerLease{
+		expiry: now.Add(pr.leaseDuration()),
+		term:   pr.getCurrentTerm(),
+	})
+}
+
+// maybeRenewLease renews the lease once this peer's heartbeats have been
+// acknowledged by a quorum of the cell, per etcd/raft's own CheckQuorum
+// bookkeeping (Progress.RecentActive). doSaveReadyState calls this once per
+// processed Ready, which is the point at which RecentActive reflects the
+// heartbeat responses collected since the last tick.
+func (pr *PeerReplicate) maybeRenewLease(now time.Time) {
+	if !pr.isLeader() {
+		return
+	}
+
+	status := pr.rn.Status()
+
+	active := 1 // self
+	for id, progress := range status.Progress {
+		if id == pr.peer.ID {
+			continue
+		}
+		if progress.RecentActive {
+			active++
+		}
+	}
+
+	if active*2 > len(pr.ps.getCell().Peers) {
+		pr.renewLease(now)
+	}
+}
+
+// leaseDuration is electionTimeout*tickInterval shortened by the configured
+// clock drift bound, so the lease always expires strictly before the
+// earliest time any follower could start a new election.
+func (pr *PeerReplicate) leaseDuration() time.Duration {
+	cfg := pr.store.cfg
+
+	drift := cfg.MaxClockDrift
+	if drift <= 0 {
+		drift = defaultMaxClockDrift
+	}
+
+	election := time.Duration(cfg.RaftElectionTick) * cfg.RaftTickInterval
+	if election <= drift {
+		return 0
+	}
+
+	return election - drift
+}
+
+// hasValidLease reports whether this peer can answer a read locally right
+// now: it must still be leader for the term the lease was renewed in, and
+// the lease must not have expired.
+func (pr *PeerReplicate) hasValidLease(now time.Time) bool {
+	lease := pr.loadLease()
+	return pr.isLeader() &&
+		lease.term == pr.getCurrentTerm() &&
+		now.Before(lease.expiry)
+}
+
+// invalidateLease clears the lease. Called on step-down and on any applied
+// conf change, both of which can change who is allowed to serve reads.
+func (pr *PeerReplicate) invalidateLease() {
+	pr.lease.Store(zeroLease)
+}
+
+// tryLeaseRead attempts to serve a read-only command without a ReadIndex
+// round trip. It returns false if that isn't possible right now and the
+// caller should fall back to the pendingReads/ReadIndex path.
+//
+// Unsafe always takes the fast path: it has no safety check to fail, by
+// design, so there's nothing here for it to fall back from. LeaseRead only
+// takes it while this peer's lease is still valid; once the lease lapses it
+// falls back exactly like ReadIndex mode, which never has a fast path to
+// begin with.
+func (pr *PeerReplicate) tryLeaseRead(c *cmd) bool {
+	switch pr.store.cfg.ReadMode {
+	case Unsafe:
+		atomic.AddUint64(&leaseReadHitCount, 1)
+		pr.doExecReadCmd(c)
+		return true
+	case LeaseRead:
+		if !pr.hasValidLease(time.Now()) || !pr.readyToHandleRead() {
+			atomic.AddUint64(&leaseReadFallbackCount, 1)
+			return false
+		}
+
+		atomic.AddUint64(&leaseReadHitCount, 1)
+		pr.doExecReadCmd(c)
+		return true
+	default:
+		return false
+	}
+}
+
+// LeaseReadHitCount reports the total number of reads served through the
+// lease-read fast path, for registration with the store's metrics exporter.
+func LeaseReadHitCount() uint64 {
+	return atomic.LoadUint64(&leaseReadHitCount)
+}
+
+// LeaseReadFallbackCount reports the total number of reads that fell back
+// to the ReadIndex path because the fast path wasn't available.
+func LeaseReadFallbackCount() uint64 {
+	return atomic.LoadUint64(&leaseReadFallbackCount)
+}
@@ -0,0 +1,278 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+const defaultRaftEntryCacheSize = 64 * 1024 * 1024
+
+// raftLogCache is a bounded, per-cell, contiguous ring of recently appended
+// raft log entries. It lets a follower catching up, or a leader re-proposing
+// after a bounce, serve Entries/Term out of memory instead of round
+// tripping to the meta engine for data that was just written.
+type raftLogCache struct {
+	sync.RWMutex
+
+	entries []raftpb.Entry // sorted by Index, contiguous
+	bytes   uint64
+	hit     uint64
+	miss    uint64
+}
+
+func newRaftLogCache() *raftLogCache {
+	return &raftLogCache{}
+}
+
+func entrySize(e *raftpb.Entry) uint64 {
+	return uint64(e.Size())
+}
+
+// append adds newly-appended entries to the tail of the cache, truncating
+// any cached suffix that overlaps them — the same case doAppendEntries
+// already handles against the meta engine when a leader change rewrites
+// the tail of the log.
+func (c *raftLogCache) append(entries []raftpb.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	first := entries[0].Index
+	if n := len(c.entries); n > 0 {
+		if first > c.entries[n-1].Index+1 || first < c.entries[0].Index {
+			// not contiguous with what we have, start over
+			c.entries = c.entries[:0]
+			c.bytes = 0
+		} else if first <= c.entries[n-1].Index {
+			idx := int(first - c.entries[0].Index)
+			for i := idx; i < n; i++ {
+				c.bytes -= entrySize(&c.entries[i])
+			}
+			c.entries = c.entries[:idx]
+		}
+	}
+
+	for i := range entries {
+		c.entries = append(c.entries, entries[i])
+		c.bytes += entrySize(&entries[i])
+	}
+}
+
+// get returns whatever cached suffix of [low, high) the cache holds, along
+// with the index at which that cached suffix starts. The cache only ever
+// holds the most recent, contiguous suffix of the log - entries are added
+// at the tail by append and dropped from the head by compactTo - so the
+// only possible gap is a missing prefix: the caller fetches [low, firstCached)
+// itself (typically from the engine) and concatenates it with the returned
+// entries to cover the whole of [low, high). firstCached == low means the
+// cache covered the whole range; firstCached == high means it is a full
+// miss.
+func (c *raftLogCache) get(low, high uint64) (cached []raftpb.Entry, firstCached uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.entries) == 0 || high <= c.entries[0].Index || low >= c.entries[len(c.entries)-1].Index+1 {
+		c.miss++
+		return nil, high
+	}
+
+	start := c.entries[0].Index
+	if start < low {
+		start = low
+	}
+
+	end := c.entries[len(c.entries)-1].Index + 1
+	if end > high {
+		end = high
+	}
+
+	c.hit++
+
+	idx0 := start - c.entries[0].Index
+	idx1 := end - c.entries[0].Index
+	out := make([]raftpb.Entry, idx1-idx0)
+	copy(out, c.entries[idx0:idx1])
+	return out, start
+}
+
+// term returns the cached term for idx, if present.
+func (c *raftLogCache) term(idx uint64) (uint64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.entries) == 0 || idx < c.entries[0].Index || idx > c.entries[len(c.entries)-1].Index {
+		return 0, false
+	}
+
+	return c.entries[idx-c.entries[0].Index].Term, true
+}
+
+// compactTo drops every cached entry at or below the truncated index.
+func (c *raftLogCache) compactTo(truncatedIndex uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	i := 0
+	for ; i < len(c.entries); i++ {
+		if c.entries[i].Index > truncatedIndex {
+			break
+		}
+		c.bytes -= entrySize(&c.entries[i])
+	}
+
+	c.entries = c.entries[:copy(c.entries, c.entries[i:])]
+}
+
+func (c *raftLogCache) size() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.bytes
+}
+
+// stats returns this cache's hit/miss/bytes counters for aggregation by
+// raftLogCacheManager.Stats.
+func (c *raftLogCache) stats() (hit, miss, bytes uint64) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.hit, c.miss, c.bytes
+}
+
+// limitEntriesSize trims a slice of entries down to maxSize bytes, always
+// keeping at least the first entry, matching the semantics of the existing
+// engine-backed Entries scan.
+func limitEntriesSize(entries []raftpb.Entry, maxSize uint64) []raftpb.Entry {
+	if len(entries) == 0 {
+		return entries
+	}
+
+	size := uint64(entries[0].Size())
+	i := 1
+	for ; i < len(entries); i++ {
+		size += uint64(entries[i].Size())
+		if size > maxSize {
+			break
+		}
+	}
+
+	return entries[:i]
+}
+
+// raftLogCacheManager bounds total raft log cache memory across every cell
+// on a store; the least recently touched cell's cache is evicted wholesale
+// once the budget is exceeded.
+type raftLogCacheManager struct {
+	sync.Mutex
+
+	maxBytes uint64
+	caches   map[uint64]*raftLogCache
+	lru      *list.List
+	elems    map[uint64]*list.Element
+}
+
+func newRaftLogCacheManager(maxBytes uint64) *raftLogCacheManager {
+	if maxBytes == 0 {
+		maxBytes = defaultRaftEntryCacheSize
+	}
+
+	return &raftLogCacheManager{
+		maxBytes: maxBytes,
+		caches:   make(map[uint64]*raftLogCache),
+		lru:      list.New(),
+		elems:    make(map[uint64]*list.Element),
+	}
+}
+
+// get returns the cache for cellID, creating it if needed, and marks it as
+// the most recently used.
+func (m *raftLogCacheManager) get(cellID uint64) *raftLogCache {
+	m.Lock()
+	defer m.Unlock()
+
+	c, ok := m.caches[cellID]
+	if !ok {
+		c = newRaftLogCache()
+		m.caches[cellID] = c
+		m.elems[cellID] = m.lru.PushFront(cellID)
+		return c
+	}
+
+	if e, ok := m.elems[cellID]; ok {
+		m.lru.MoveToFront(e)
+	}
+
+	return c
+}
+
+// reclaim evicts least-recently-touched cell caches until total cached
+// bytes fit within maxBytes. Call after populating a cache.
+func (m *raftLogCacheManager) reclaim() {
+	m.Lock()
+	defer m.Unlock()
+
+	var total uint64
+	for _, c := range m.caches {
+		total += c.size()
+	}
+
+	for total > m.maxBytes {
+		back := m.lru.Back()
+		if back == nil {
+			return
+		}
+
+		cellID := back.Value.(uint64)
+		if c, ok := m.caches[cellID]; ok {
+			total -= c.size()
+			delete(m.caches, cellID)
+		}
+
+		m.lru.Remove(back)
+		delete(m.elems, cellID)
+	}
+}
+
+// Stats aggregates hit/miss/bytes across every cell's cache, for
+// registration with the store's metrics exporter.
+func (m *raftLogCacheManager) Stats() (hit, miss, bytes uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, c := range m.caches {
+		h, ms, b := c.stats()
+		hit += h
+		miss += ms
+		bytes += b
+	}
+
+	return
+}
+
+// delete drops a cell's cache entirely, e.g. once the peer is destroyed.
+func (m *raftLogCacheManager) delete(cellID uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.caches, cellID)
+	if e, ok := m.elems[cellID]; ok {
+		m.lru.Remove(e)
+		delete(m.elems, cellID)
+	}
+}
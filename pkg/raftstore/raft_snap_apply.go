@@ -0,0 +1,199 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/deepfabric/elasticell/pkg/log"
+)
+
+// snapApplyState describes the lifecycle of an in-flight apply-snapshot job.
+// It is kept as an atomic int32 on peerStorage so the raft goroutine and the
+// apply-snapshot worker can observe and CAS it without taking a lock.
+type snapApplyState int32
+
+const (
+	snapApplyIdle snapApplyState = iota
+	snapApplyApplying
+	snapApplyAborting
+	snapApplyAborted
+	snapApplySuccess
+	snapApplyFailed
+)
+
+// snapApplyResult is delivered through store.notify once the apply-snapshot
+// worker stops, letting doPostApplyResult tell a normal completion apart
+// from one cut short because the peer is being destroyed.
+type snapApplyResult struct {
+	cellID  uint64
+	success bool
+	aborted bool
+}
+
+// isApplyingSnap reports whether this peer currently has an apply-snapshot
+// job in flight. applyCommittedEntries and doPostApply both consult this so
+// a normal log-apply job and a snapshot-apply job never run concurrently
+// against the same peer's data.
+func (ps *peerStorage) isApplyingSnap() bool {
+	switch ps.getApplySnapState() {
+	case snapApplyApplying, snapApplyAborting:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ps *peerStorage) getApplySnapState() snapApplyState {
+	return snapApplyState(atomic.LoadInt32(&ps.applySnapState))
+}
+
+func (ps *peerStorage) setApplySnapState(state snapApplyState) {
+	atomic.StoreInt32(&ps.applySnapState, int32(state))
+}
+
+func (ps *peerStorage) casApplySnapState(old, new snapApplyState) bool {
+	return atomic.CompareAndSwapInt32(&ps.applySnapState, int32(old), int32(new))
+}
+
+// beginApplyingSnap transitions the peer into Applying, the only state from
+// which the apply-snapshot worker is allowed to start, and fails loudly if
+// some previous job never reached a terminal state.
+func (ps *peerStorage) beginApplyingSnap() {
+	if ps.casApplySnapState(snapApplyIdle, snapApplyApplying) {
+		return
+	}
+
+	if ps.casApplySnapState(snapApplyFailed, snapApplyApplying) ||
+		ps.casApplySnapState(snapApplySuccess, snapApplyApplying) ||
+		ps.casApplySnapState(snapApplyAborted, snapApplyApplying) {
+		return
+	}
+
+	log.Fatalf("raftstore[cell-%d]: start apply snapshot job with unexpected state=<%d>",
+		ps.getCell().ID,
+		ps.getApplySnapState())
+}
+
+// startAbortApplySnap asks an in-flight apply-snapshot job to stop as soon
+// as possible. It returns false if there was nothing applying, in which
+// case the caller can clean the peer up immediately.
+func (ps *peerStorage) startAbortApplySnap() bool {
+	return ps.casApplySnapState(snapApplyApplying, snapApplyAborting)
+}
+
+// waitApplySnapAborted blocks until the apply-snapshot worker has observed
+// the abort request and left the Aborting state. Only meaningful after
+// startAbortApplySnap returned true.
+func (ps *peerStorage) waitApplySnapAborted() {
+	for {
+		switch ps.getApplySnapState() {
+		case snapApplyAborted, snapApplySuccess, snapApplyFailed:
+			return
+		default:
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+// abortApplyingSnap cooperatively cancels an in-flight apply-snapshot job
+// for this peer and blocks until the worker has acknowledged the abort.
+// doApplyConfChange calls this right before Store.destroyPeer when a conf
+// change removes this peer, so that removal never has to wait for a multi-GB
+// snapshot to finish applying to rocksdb.
+func (ps *peerStorage) abortApplyingSnap() {
+	if !ps.startAbortApplySnap() {
+		return
+	}
+
+	ps.waitApplySnapAborted()
+
+	// A destroy racing with a chunked transfer shouldn't leak whatever was
+	// already staged to disk.
+	discardStagedSnapChunks(ps.snapStageDir())
+}
+
+// startApplyingSnapJob launches the worker goroutine that ingests the
+// chunks staged for this peer's snapshot into the data engine. It returns
+// immediately; the worker reports back through store.notify once it stops,
+// whether that's because it finished, failed, or was cooperatively aborted.
+func (pr *PeerReplicate) startApplyingSnapJob() {
+	go pr.ps.doApplySnapshotDataJob()
+}
+
+// doApplySnapshotDataJob is the apply-snapshot worker. It polls
+// getApplySnapState() via applyStagedSnapChunks, which checks the state
+// between every chunk it ingests, so a concurrent abortApplyingSnap only
+// has to wait out the chunk that's already in flight rather than the whole
+// transfer.
+//
+// The worker CASes its own terminal state here, before it ever calls
+// store.notify. doPostApplySnapResult runs on the store's notify-consumer
+// goroutine, and abortApplyingSnap's waitApplySnapAborted can itself be
+// called from that same goroutine (via doApplyConfChange); if the terminal
+// state only ever got set inside doPostApplySnapResult, that spin would
+// wait forever for a result the very goroutine it's running on is the one
+// meant to drain. Setting it here means waitApplySnapAborted always
+// observes completion regardless of which goroutine is asking.
+func (ps *peerStorage) doApplySnapshotDataJob() {
+	err := ps.applyStagedSnapChunks()
+
+	result := &snapApplyResult{cellID: ps.getCell().ID}
+
+	switch {
+	case ps.getApplySnapState() == snapApplyAborting:
+		result.aborted = true
+		ps.setApplySnapState(snapApplyAborted)
+	case err != nil:
+		log.Errorf("raftstore[cell-%d]: apply snapshot data failed, errors:\n %+v",
+			ps.getCell().ID,
+			err)
+		result.success = false
+		ps.setApplySnapState(snapApplyFailed)
+	default:
+		result.success = true
+		ps.setApplySnapState(snapApplySuccess)
+	}
+
+	ps.store.notify(result)
+}
+
+// doPostApplySnapResult handles the outcome of an apply-snapshot worker.
+// The terminal state is already set by doApplySnapshotDataJob itself by the
+// time this runs (possibly much later, since it's just queued through
+// store.notify) - this only does the logging/bookkeeping side, and must
+// never block, since it can run on the same goroutine a concurrent
+// waitApplySnapAborted is spinning from.
+func (s *Store) doPostApplySnapResult(result *snapApplyResult) {
+	pr := s.replicatesMap.get(result.cellID)
+	if nil == pr {
+		log.Fatalf("raftstore-apply[cell-%d]: missing cell",
+			result.cellID)
+	}
+
+	if result.aborted {
+		log.Infof("raftstore[cell-%d]: apply snapshot aborted, skip post apply",
+			result.cellID)
+		return
+	}
+
+	if !result.success {
+		log.Errorf("raftstore[cell-%d]: apply snapshot failed",
+			result.cellID)
+		return
+	}
+
+	log.Infof("raftstore[cell-%d]: apply snapshot succeeded", result.cellID)
+}
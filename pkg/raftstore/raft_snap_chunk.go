@@ -0,0 +1,443 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/deepfabric/elasticell/pkg/pb/metapb"
+)
+
+const (
+	defaultSnapChunkSize          = 4 * 1024 * 1024
+	defaultSnapMaxConcurrentSends = 4
+	defaultSnapReceiveTimeoutSecs = 60
+
+	snapManifestFileName = "manifest.json"
+)
+
+// snapManifest is what now travels inside raftpb.Snapshot.Data: the actual
+// cell data is staged on disk as numbered chunk files and fetched out of
+// band over the sidecar transport, so a multi-GB cell never has to fit in
+// a single raft message.
+type snapManifest struct {
+	Cell        metapb.Cell
+	Index       uint64
+	Term        uint64
+	ChunkCount  int
+	ChunkCRC32s []uint32
+	TotalCRC32  uint32
+}
+
+func (m snapManifest) marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func unmarshalManifest(data []byte) (snapManifest, error) {
+	var m snapManifest
+	err := json.Unmarshal(data, &m)
+	return m, err
+}
+
+// totalManifestCRC combines every per-chunk CRC32 into the single checksum
+// stored in TotalCRC32, so a manifest whose per-chunk CRC list is corrupt
+// can never reach startApplyingSnapJob. It covers the CRC values only, not
+// the chunk data; each chunk is checked against its own CRC32.
+func totalManifestCRC(chunkCRC32s []uint32) uint32 {
+	h := crc32.NewIEEE()
+	buf := make([]byte, 4)
+	for _, c := range chunkCRC32s {
+		binary.BigEndian.PutUint32(buf, c)
+		h.Write(buf)
+	}
+
+	return h.Sum32()
+}
+
+// validateManifestCRC checks the total CRC32 across all per-chunk CRCs.
+func validateManifestCRC(manifest snapManifest) bool {
+	return totalManifestCRC(manifest.ChunkCRC32s) == manifest.TotalCRC32
+}
+
+func chunkFilePath(stageDir string, index int) string {
+	return filepath.Join(stageDir, fmt.Sprintf("chunk_%08d", index))
+}
+
+func manifestFilePath(stageDir string) string {
+	return filepath.Join(stageDir, snapManifestFileName)
+}
+
+// writeStagedManifest persists the manifest for a chunked transfer so the
+// apply worker can read it back even if the process restarts mid-transfer.
+func writeStagedManifest(stageDir string, manifest snapManifest) error {
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := manifest.marshal()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(manifestFilePath(stageDir), data, 0644)
+}
+
+// readStagedManifest loads a manifest previously written by
+// writeStagedManifest.
+func readStagedManifest(stageDir string) (snapManifest, error) {
+	data, err := ioutil.ReadFile(manifestFilePath(stageDir))
+	if err != nil {
+		return snapManifest{}, err
+	}
+
+	return unmarshalManifest(data)
+}
+
+// cellDataIngester is implemented by the data engine to apply one staged
+// snapshot chunk's worth of key-value data for a cell. It lets the
+// apply-snapshot worker ingest chunk-by-chunk without knowing the engine's
+// on-disk layout.
+type cellDataIngester interface {
+	IngestChunk(cell metapb.Cell, data []byte) error
+}
+
+// snapChunkReceiveJob fetches the chunks described by a manifest from the
+// sending peer's sidecar transport, verifying each one against its CRC32
+// and staging it to disk before the apply-snapshot worker ever looks at it.
+// It resumes from the last verified chunk on reconnect instead of
+// restarting the whole transfer.
+type snapChunkReceiveJob struct {
+	ps        *peerStorage
+	manifest  snapManifest
+	stageDir  string
+	nextChunk int
+}
+
+func newSnapChunkReceiveJob(ps *peerStorage, manifest snapManifest, stageDir string) *snapChunkReceiveJob {
+	return &snapChunkReceiveJob{
+		ps:       ps,
+		manifest: manifest,
+		stageDir: stageDir,
+	}
+}
+
+// resumeFrom picks up the transfer at the first chunk index this job still
+// needs, based on whatever chunk files already exist from a previous,
+// interrupted attempt.
+func (j *snapChunkReceiveJob) resumeFrom(verified int) {
+	j.nextChunk = verified
+}
+
+// verifyChunk checks a single received chunk's CRC32 against the manifest
+// before the chunk is considered durable.
+func (j *snapChunkReceiveJob) verifyChunk(index int, data []byte) error {
+	if index < 0 || index >= len(j.manifest.ChunkCRC32s) {
+		return fmt.Errorf("raftstore[cell-%d]: snap chunk index out of range, index=<%d> count=<%d>",
+			j.manifest.Cell.ID,
+			index,
+			j.manifest.ChunkCount)
+	}
+
+	if got := crc32.ChecksumIEEE(data); got != j.manifest.ChunkCRC32s[index] {
+		return fmt.Errorf("raftstore[cell-%d]: snap chunk checksum mismatch, index=<%d> expect=<%d> got=<%d>",
+			j.manifest.Cell.ID,
+			index,
+			j.manifest.ChunkCRC32s[index],
+			got)
+	}
+
+	return nil
+}
+
+// receiveChunk verifies and stages a single chunk, the unit of work the
+// sidecar transport's stream handler calls once per chunk it pulls off the
+// wire. Chunks before nextChunk are assumed already staged and are
+// skipped, which is what makes resuming after a reconnect cheap.
+func (j *snapChunkReceiveJob) receiveChunk(index int, data []byte) error {
+	if index < j.nextChunk {
+		return nil
+	}
+
+	if err := j.verifyChunk(index, data); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(j.stageDir, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(chunkFilePath(j.stageDir, index), data, 0644); err != nil {
+		return err
+	}
+
+	j.nextChunk = index + 1
+	return nil
+}
+
+// done reports whether every chunk in the manifest has been received.
+func (j *snapChunkReceiveJob) done() bool {
+	return j.nextChunk >= j.manifest.ChunkCount
+}
+
+// snapChunkFetcher is implemented by the store's transport to pull one
+// chunk of a cell's snapshot data from the peer that sent it, the sidecar
+// path chunks travel over instead of raft's own message path.
+type snapChunkFetcher interface {
+	FetchSnapChunk(to metapb.Peer, cellID uint64, index int) ([]byte, error)
+}
+
+// stagedChunkCount reports how many leading chunks of a transfer already
+// sit on disk from a previous, interrupted attempt, so a retry can resume
+// instead of re-fetching everything.
+func stagedChunkCount(stageDir string, total int) int {
+	n := 0
+	for n < total {
+		if _, err := os.Stat(chunkFilePath(stageDir, n)); err != nil {
+			break
+		}
+		n++
+	}
+
+	return n
+}
+
+// fetchAndStageSnapChunks drives a snapChunkReceiveJob to completion: it
+// stages the manifest first, so a crash mid-transfer can resume against it,
+// then pulls and verifies every chunk the job doesn't already have from the
+// peer that sent the snapshot.
+func (ps *peerStorage) fetchAndStageSnapChunks(manifest snapManifest, from metapb.Peer) error {
+	stageDir := ps.snapStageDir()
+
+	if err := writeStagedManifest(stageDir, manifest); err != nil {
+		return err
+	}
+
+	fetcher, ok := ps.store.trans.(snapChunkFetcher)
+	if !ok {
+		return fmt.Errorf("raftstore[cell-%d]: transport does not support chunked snapshot fetch",
+			manifest.Cell.ID)
+	}
+
+	job := newSnapChunkReceiveJob(ps, manifest, stageDir)
+	job.resumeFrom(stagedChunkCount(stageDir, manifest.ChunkCount))
+
+	for !job.done() {
+		data, err := fetcher.FetchSnapChunk(from, manifest.Cell.ID, job.nextChunk)
+		if err != nil {
+			return err
+		}
+
+		if err := job.receiveChunk(job.nextChunk, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapStageDir is the local staging directory a chunked transfer writes
+// into, and the directory discardStagedSnapChunks removes on abort.
+func (ps *peerStorage) snapStageDir() string {
+	return filepath.Join(ps.store.cfg.SnapDir, fmt.Sprintf("cell_%d", ps.getCell().ID))
+}
+
+// discardStagedSnapChunks removes any partially received chunk files for a
+// cell so a destroy that races with an in-flight snapshot transfer doesn't
+// leak disk space.
+func discardStagedSnapChunks(stageDir string) {
+	os.RemoveAll(stageDir)
+}
+
+// cellDataScanner is implemented by the data engine to walk a cell's data
+// in key order, the source side of the same chunked-transfer contract
+// cellDataIngester is the sink side of.
+type cellDataScanner interface {
+	ScanCell(cell metapb.Cell, handler func(key, value []byte) (bool, error)) error
+}
+
+// doGenerateSnapshotJob scans this cell's data out of the data engine,
+// splits it into defaultSnapChunkSize chunks, stages each one to disk with
+// its CRC32, and returns a raftpb.Snapshot whose Data is just the manifest.
+// The chunks themselves go out over the sidecar transport, never through
+// raft's own message path.
+func (ps *peerStorage) doGenerateSnapshotJob() (interface{}, error) {
+	cell := ps.getCell()
+	stageDir := ps.snapStageDir()
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return nil, err
+	}
+
+	scanner, ok := ps.store.getDataEngine().(cellDataScanner)
+	if !ok {
+		return nil, fmt.Errorf("raftstore[cell-%d]: data engine does not support chunked snapshot scan",
+			cell.ID)
+	}
+
+	var chunkCRC32s []uint32
+	buf := make([]byte, 0, defaultSnapChunkSize)
+
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+
+		index := len(chunkCRC32s)
+		if err := ioutil.WriteFile(chunkFilePath(stageDir, index), buf, 0644); err != nil {
+			return err
+		}
+
+		chunkCRC32s = append(chunkCRC32s, crc32.ChecksumIEEE(buf))
+		buf = make([]byte, 0, defaultSnapChunkSize)
+		return nil
+	}
+
+	var scanErr error
+	err := scanner.ScanCell(cell, func(key, value []byte) (bool, error) {
+		var kv [8]byte
+		binary.BigEndian.PutUint32(kv[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint32(kv[4:8], uint32(len(value)))
+
+		buf = append(buf, kv[:]...)
+		buf = append(buf, key...)
+		buf = append(buf, value...)
+
+		if len(buf) >= defaultSnapChunkSize {
+			if scanErr = flush(); scanErr != nil {
+				return false, scanErr
+			}
+		}
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	manifest := snapManifest{
+		Cell:        cell,
+		Index:       ps.getTruncatedIndex(),
+		Term:        ps.getTruncatedTerm(),
+		ChunkCount:  len(chunkCRC32s),
+		ChunkCRC32s: chunkCRC32s,
+	}
+	manifest.TotalCRC32 = totalManifestCRC(chunkCRC32s)
+
+	if err := writeStagedManifest(stageDir, manifest); err != nil {
+		return nil, err
+	}
+
+	data, err := manifest.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &raftpb.Snapshot{
+		Data: data,
+		Metadata: raftpb.SnapshotMetadata{
+			Index:     manifest.Index,
+			Term:      manifest.Term,
+			ConfState: confStateFromCell(cell),
+		},
+	}, nil
+}
+
+// confStateFromCell builds the ConfState a restored peer needs to recover
+// its membership, splitting cell.Peers into voters and learners the same
+// way InitialState does.
+func confStateFromCell(cell metapb.Cell) raftpb.ConfState {
+	var confState raftpb.ConfState
+
+	for _, p := range cell.Peers {
+		if p.Role == metapb.Learner {
+			confState.Learners = append(confState.Learners, p.ID)
+		} else {
+			confState.Nodes = append(confState.Nodes, p.ID)
+		}
+	}
+
+	return confState
+}
+
+// validateSnap checks a freshly generated snapshot's manifest before it is
+// handed to raft: a corrupt manifest here would otherwise only be caught
+// much later, by the receiving peer, after the round trip.
+func (ps *peerStorage) validateSnap(snap *raftpb.Snapshot) bool {
+	manifest, err := unmarshalManifest(snap.Data)
+	if err != nil {
+		return false
+	}
+
+	return validateManifestCRC(manifest)
+}
+
+// applyStagedSnapChunks reads the manifest staged by the receive job and
+// ingests each chunk into the data engine in order. It checks the
+// apply-snapshot CAS state between chunks so a destroy racing with a large
+// transfer only has to wait for the in-flight chunk, not the whole thing.
+func (ps *peerStorage) applyStagedSnapChunks() error {
+	stageDir := ps.snapStageDir()
+
+	manifest, err := readStagedManifest(stageDir)
+	if err != nil {
+		return err
+	}
+
+	if !validateManifestCRC(manifest) {
+		return fmt.Errorf("raftstore[cell-%d]: snapshot manifest checksum mismatch",
+			manifest.Cell.ID)
+	}
+
+	ingester, ok := ps.store.getDataEngine().(cellDataIngester)
+	if !ok {
+		return fmt.Errorf("raftstore[cell-%d]: data engine does not support chunked snapshot ingest",
+			manifest.Cell.ID)
+	}
+
+	for i := 0; i < manifest.ChunkCount; i++ {
+		if ps.getApplySnapState() == snapApplyAborting {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(chunkFilePath(stageDir, i))
+		if err != nil {
+			return err
+		}
+
+		if crc32.ChecksumIEEE(data) != manifest.ChunkCRC32s[i] {
+			return fmt.Errorf("raftstore[cell-%d]: snap chunk checksum mismatch, index=<%d>",
+				manifest.Cell.ID,
+				i)
+		}
+
+		if err := ingester.IngestChunk(manifest.Cell, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
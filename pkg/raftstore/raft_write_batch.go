@@ -0,0 +1,54 @@
+// Copyright 2016 DeepFabric, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+// metaWriteBatch is the subset of the meta engine's write-batch type that
+// raftstore needs to fold all of one raft Ready's persistence (appended
+// entries, truncated tail deletes, RaftLocalState, RaftApplyState) into a
+// single Commit, and therefore a single fsync.
+type metaWriteBatch interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Commit() error
+}
+
+// metaWriteBatchEngine is implemented by the meta engine to hand out fresh
+// write batches.
+type metaWriteBatchEngine interface {
+	NewWriteBatch() metaWriteBatch
+}
+
+// writeBatch lazily creates the batch for this Ready cycle: whichever of
+// the doAppend*/doSave* helpers writes first creates it, and the rest of the
+// cycle's writes go into the same batch.
+func (ctx *tempRaftContext) writeBatch(engine metaWriteBatchEngine) metaWriteBatch {
+	if ctx.wb == nil {
+		ctx.wb = engine.NewWriteBatch()
+	}
+
+	return ctx.wb
+}
+
+// commit flushes and fsyncs everything accumulated in the batch for this
+// Ready cycle. It is a no-op if nothing was ever buffered into the batch.
+func (ctx *tempRaftContext) commit() error {
+	if ctx.wb == nil {
+		return nil
+	}
+
+	err := ctx.wb.Commit()
+	ctx.wb = nil
+	ctx.wbBytes = 0
+	return err
+}